@@ -0,0 +1,116 @@
+package migrations
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// writeTarGzip writes a gzip-compressed tar archive containing a single
+// file, dir/name, with the given contents, to w.
+func writeTarGzip(dir, name, contents string, w io.Writer) error {
+	gzw := gzip.NewWriter(w)
+	defer gzw.Close()
+
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	hdr := &tar.Header{
+		Name: path.Join(dir, name),
+		Mode: 0755,
+		Size: int64(len(contents)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write([]byte(contents))
+	return err
+}
+
+// writeZip writes a zip archive containing a single file, dir/name, with
+// the given contents, to w.
+func writeZip(dir, name, contents string, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	fw, err := zw.Create(path.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write([]byte(contents))
+	return err
+}
+
+// unpackArchive extracts the named binary from the archive read from r, and
+// writes it to the file at destPath. The archive is assumed to be gzipped
+// tar if archiveZip is false, and zip otherwise.
+func unpackArchive(r io.Reader, archiveZip bool, binName, destPath string) error {
+	if archiveZip {
+		return unpackZip(r, binName, destPath)
+	}
+	return unpackTarGzip(r, binName, destPath)
+}
+
+func unpackTarGzip(r io.Reader, binName, destPath string) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("no binary found in archive")
+		}
+		if err != nil {
+			return err
+		}
+		if filepath.Base(hdr.Name) != binName {
+			continue
+		}
+		return writeExtractedFile(tr, destPath, hdr.FileInfo().Mode())
+	}
+}
+
+func unpackZip(r io.Reader, binName, destPath string) error {
+	// zip.Reader requires io.ReaderAt, so buffer the archive in memory.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) != binName {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return writeExtractedFile(rc, destPath, f.Mode())
+	}
+	return fmt.Errorf("no binary found in archive")
+}
+
+func writeExtractedFile(r io.Reader, destPath string, mode os.FileMode) error {
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	return err
+}
@@ -0,0 +1,293 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// envMigrationsCache disables the cache entirely when set to "off", the
+	// same convention GOFLAGS=-mod=off style env vars use.
+	envMigrationsCache = "IPFS_MIGRATIONS_CACHE"
+
+	envIpfsPath     = "IPFS_PATH"
+	envXdgCacheHome = "XDG_CACHE_HOME"
+
+	cacheDirName = "migration-cache"
+)
+
+// Cache is a content-addressed, on-disk cache of downloaded migration
+// archives, analogous to the module download cache that "go mod" keeps
+// under GOMODCACHE. It sits in front of a Fetcher: FetchBinary calls that
+// go through the cache only hit the network when no valid cached copy of
+// the archive for dist/ver exists.
+//
+// Each cached archive is stored as "<dist>/<ver>/<sha256>.<ext>" alongside
+// a "<sha256>.<ext>.sum" file recording its checksum, so that a later
+// FetchBinary call can detect a corrupted or tampered cache entry and
+// re-fetch rather than serving bad bytes.
+type Cache struct {
+	dir      string
+	disabled bool
+	group    singleflight.Group
+}
+
+// NewCache creates a Cache rooted at dir. If dir is empty, it defaults to
+// "$IPFS_PATH/migration-cache", falling back to
+// "$XDG_CACHE_HOME/ipfs-migrations" and then "~/.cache/ipfs-migrations". If
+// the IPFS_MIGRATIONS_CACHE environment variable is set to "off", the
+// returned Cache is disabled and every FetchBinary call passes straight
+// through to the network.
+func NewCache(dir string) (*Cache, error) {
+	if os.Getenv(envMigrationsCache) == "off" {
+		return &Cache{disabled: true}, nil
+	}
+
+	if dir == "" {
+		var err error
+		dir, err = defaultCacheDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Cache{dir: dir}, nil
+}
+
+func defaultCacheDir() (string, error) {
+	if ipfsPath := os.Getenv(envIpfsPath); ipfsPath != "" {
+		return filepath.Join(ipfsPath, cacheDirName), nil
+	}
+	if xdgCache := os.Getenv(envXdgCacheHome); xdgCache != "" {
+		return filepath.Join(xdgCache, "ipfs-migrations"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "ipfs-migrations"), nil
+}
+
+// cacheEntry describes an archive that is present in the cache directory.
+type cacheEntry struct {
+	path string
+	zip  bool
+}
+
+// FetchBinary behaves like the package-level FetchBinary, except that the
+// archive for dist/ver is downloaded through fetcher at most once: a valid
+// cached copy is reused, and concurrent calls for the same dist/ver share a
+// single in-flight download.
+func (c *Cache) FetchBinary(ctx context.Context, fetcher Fetcher, dist, ver, binName, outPath string, expectedRoot cid.Cid) (string, error) {
+	if c == nil || c.disabled {
+		return FetchBinary(ctx, fetcher, dist, ver, binName, outPath, expectedRoot)
+	}
+
+	name := binaryName(dist, binName)
+	destPath, err := destBinPath(outPath, name)
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := c.cachedArchive(ctx, fetcher, dist, ver, expectedRoot)
+	if err != nil {
+		return "", err
+	}
+
+	// Run the hook on every call, not just a fresh download: the archive at
+	// entry.path is just as good a candidate for re-seeding when it was
+	// already sitting in the cache as when it was just fetched.
+	if hook := postFetchHookFor(fetcher); hook != nil {
+		if err := hook(ctx, dist, ver, entry.path); err != nil {
+			return "", fmt.Errorf("post-fetch hook: %w", err)
+		}
+	}
+
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	tmpDir, err := ioutil.TempDir("", dist)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpBin := filepath.Join(tmpDir, name)
+	if err = unpackArchive(f, entry.zip, name, tmpBin); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmpBin, destPath); err != nil {
+		return "", err
+	}
+
+	return destPath, nil
+}
+
+// cachedArchive returns the cache entry for dist/ver, downloading and
+// storing it through fetcher first if necessary. Concurrent calls for the
+// same dist/ver are collapsed into a single download.
+func (c *Cache) cachedArchive(ctx context.Context, fetcher Fetcher, dist, ver string, expectedRoot cid.Cid) (cacheEntry, error) {
+	key := dist + "/" + ver
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		return c.loadOrFetch(ctx, fetcher, dist, ver, expectedRoot)
+	})
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	return v.(cacheEntry), nil
+}
+
+func (c *Cache) loadOrFetch(ctx context.Context, fetcher Fetcher, dist, ver string, expectedRoot cid.Cid) (cacheEntry, error) {
+	dir := filepath.Join(c.dir, dist, ver)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return cacheEntry{}, err
+	}
+
+	if entry, ok := c.validEntry(dir); ok {
+		return entry, nil
+	}
+
+	rc, err := fetchArchive(ctx, fetcher, dist, ver, expectedRoot)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	defer rc.Close()
+
+	return c.store(dir, rc)
+}
+
+// validEntry looks for an archive already in dir whose contents still
+// match its recorded checksum, evicting any entry that does not.
+func (c *Cache) validEntry(dir string) (cacheEntry, bool) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasSuffix(name, ".sum") {
+			continue
+		}
+		archivePath := filepath.Join(dir, name)
+		if err := verifyChecksum(archivePath); err != nil {
+			os.Remove(archivePath)
+			os.Remove(archivePath + ".sum")
+			continue
+		}
+		return cacheEntry{path: archivePath, zip: strings.HasSuffix(name, ".zip")}, true
+	}
+	return cacheEntry{}, false
+}
+
+// store copies r into dir as a new cache entry, named for its own sha256
+// checksum, and writes the accompanying .sum file.
+func (c *Cache) store(dir string, r io.Reader) (cacheEntry, error) {
+	tmp, err := ioutil.TempFile(dir, ".download-*")
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		return cacheEntry{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return cacheEntry{}, err
+	}
+
+	archiveZip := runtime.GOOS == "windows"
+	ext := "tar.gz"
+	if archiveZip {
+		ext = "zip"
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	archivePath := filepath.Join(dir, sum+"."+ext)
+
+	if err := os.Rename(tmp.Name(), archivePath); err != nil {
+		return cacheEntry{}, err
+	}
+	if err := ioutil.WriteFile(archivePath+".sum", []byte(sum+"\n"), 0644); err != nil {
+		return cacheEntry{}, err
+	}
+
+	return cacheEntry{path: archivePath, zip: archiveZip}, nil
+}
+
+// Verify walks every entry in the cache and checks that its contents still
+// match its recorded checksum, returning an error describing every entry
+// that fails.
+func (c *Cache) Verify(ctx context.Context) error {
+	if c == nil || c.disabled {
+		return nil
+	}
+
+	var bad []string
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(p, ".sum") {
+			return nil
+		}
+		if verr := verifyChecksum(p); verr != nil {
+			bad = append(bad, fmt.Sprintf("%s: %s", p, verr))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("corrupt cache entries:\n%s", strings.Join(bad, "\n"))
+	}
+	return nil
+}
+
+// verifyChecksum recomputes the sha256 of the file at archivePath and
+// compares it to the checksum recorded in archivePath + ".sum".
+func verifyChecksum(archivePath string) error {
+	wantBytes, err := ioutil.ReadFile(archivePath + ".sum")
+	if err != nil {
+		return err
+	}
+	want := strings.TrimSpace(string(wantBytes))
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+
+	if got != want {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", got, want)
+	}
+	return nil
+}
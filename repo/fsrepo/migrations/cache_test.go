@@ -0,0 +1,216 @@
+package migrations
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// countingFetcher wraps another Fetcher and counts how many times Fetch is
+// called, so tests can assert that the cache avoided the network.
+type countingFetcher struct {
+	Fetcher
+	fetches int32
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	atomic.AddInt32(&f.fetches, 1)
+	return f.Fetcher.Fetch(ctx, filePath)
+}
+
+func TestCacheAvoidsRefetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	hf := NewHttpFetcher()
+	if err := hf.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &countingFetcher{Fetcher: hf}
+
+	cacheDir := t.TempDir()
+	cache, err := NewCache(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outDir1 := t.TempDir()
+	if _, err := cache.FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", outDir1, cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&fetcher.fetches); got != 1 {
+		t.Fatalf("expected 1 fetch, got %d", got)
+	}
+
+	outDir2 := t.TempDir()
+	if _, err := cache.FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", outDir2, cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&fetcher.fetches); got != 1 {
+		t.Fatalf("expected cache hit to avoid a second fetch, got %d fetches", got)
+	}
+}
+
+func TestCacheRefetchesOnCorruption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	hf := NewHttpFetcher()
+	if err := hf.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &countingFetcher{Fetcher: hf}
+
+	cacheDir := t.TempDir()
+	cache, err := NewCache(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := t.TempDir()
+	if _, err := cache.FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", outDir, cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+
+	corruptCacheEntry(t, cacheDir, "go-ipfs", "v0.3.5")
+
+	outDir2 := t.TempDir()
+	if _, err := cache.FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", outDir2, cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+	// Two downloads, each fetching the archive and its detached signature.
+	if got := atomic.LoadInt32(&fetcher.fetches); got != 4 {
+		t.Fatalf("expected corrupted entry to trigger a refetch, got %d fetches", got)
+	}
+}
+
+func TestCacheDisabledByEnv(t *testing.T) {
+	os.Setenv(envMigrationsCache, "off")
+	defer os.Unsetenv(envMigrationsCache)
+
+	cache, err := NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.disabled {
+		t.Fatal("expected cache to be disabled")
+	}
+}
+
+func TestCacheVerifyDetectsCorruption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	hf := NewHttpFetcher()
+	if err := hf.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := t.TempDir()
+	cache, err := NewCache(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cache.FetchBinary(ctx, hf, "go-ipfs", "v0.3.5", "ipfs", t.TempDir(), cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Verify(ctx); err != nil {
+		t.Fatalf("expected freshly-downloaded cache to verify clean: %s", err)
+	}
+
+	corruptCacheEntry(t, cacheDir, "go-ipfs", "v0.3.5")
+
+	if err := cache.Verify(ctx); err == nil {
+		t.Fatal("expected Verify to detect the corrupted entry")
+	}
+}
+
+// TestCacheFetchBinaryRunsPostFetchHook checks that Cache.FetchBinary runs
+// a configured PostFetchHook on both a cache miss (the archive is fetched
+// over the network) and a subsequent cache hit (the archive already sits on
+// disk), since re-seeding a migration is just as useful when it is served
+// out of the cache as when it was just downloaded.
+func TestCacheFetchBinaryRunsPostFetchHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	hf := NewHttpFetcher()
+	if err := hf.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &recordingHook{}
+	hf.PostFetchHook = h.hook
+
+	cacheDir := t.TempDir()
+	cache, err := NewCache(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cache.FetchBinary(ctx, hf, "go-ipfs", "v0.3.5", "ipfs", t.TempDir(), cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+	if !h.called {
+		t.Fatal("expected post-fetch hook to run on a cache miss")
+	}
+	missPath := h.archivePath
+
+	h.called = false
+	if _, err := cache.FetchBinary(ctx, hf, "go-ipfs", "v0.3.5", "ipfs", t.TempDir(), cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+	if !h.called {
+		t.Fatal("expected post-fetch hook to run on a cache hit too")
+	}
+	if h.archivePath != missPath {
+		t.Errorf("expected cache hit to reuse the same archive path: got %s, want %s", h.archivePath, missPath)
+	}
+}
+
+// corruptCacheEntry flips a byte in the cached archive for dist/ver without
+// touching its .sum file, simulating on-disk corruption or tampering.
+func corruptCacheEntry(t *testing.T, cacheDir, dist, ver string) {
+	t.Helper()
+	dir := filepath.Join(cacheDir, dist, ver)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".sum") {
+			continue
+		}
+		p := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-1] ^= 0xff
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatal("no cache entry found to corrupt")
+}
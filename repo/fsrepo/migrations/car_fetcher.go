@@ -0,0 +1,141 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	blocks "github.com/ipfs/go-block-format"
+	blockservice "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	car "github.com/ipld/go-car"
+)
+
+// carMediaType is the media type requested from trustless gateways so that
+// the response is a CAR stream rather than the raw bytes of the resolved
+// path.
+const carMediaType = "application/vnd.ipld.car"
+
+// VerifiedHttpFetcher fetches migration archives as CAR streams from a
+// trustless IPFS gateway, verifying every block against its CID as it is
+// read so that a compromised or malicious mirror cannot hand back tampered
+// data. Unlike HttpFetcher, it does not trust the gateway to serve the
+// correct bytes for a path; it only trusts the root CID supplied by the
+// caller.
+type VerifiedHttpFetcher struct {
+	*HttpFetcher
+	cidsByVersion map[string]cid.Cid
+}
+
+var _ Fetcher = (*VerifiedHttpFetcher)(nil)
+
+// NewVerifiedHttpFetcher creates a VerifiedHttpFetcher that fetches
+// archives from gateway as CAR files, verifying that each one resolves to
+// the root CID recorded in cidsByVersion for its "<dist>/<ver>" key. The
+// map is expected to come from a signed, pinned versions manifest rather
+// than from the gateway itself.
+func NewVerifiedHttpFetcher(gateway string, cidsByVersion map[string]cid.Cid) (*VerifiedHttpFetcher, error) {
+	hf := NewHttpFetcher()
+	if err := hf.SetGateway(gateway); err != nil {
+		return nil, err
+	}
+	return &VerifiedHttpFetcher{
+		HttpFetcher:   hf,
+		cidsByVersion: cidsByVersion,
+	}, nil
+}
+
+// RootCID returns the root CID pinned for dist/ver, as recorded in the
+// cidsByVersion map supplied to NewVerifiedHttpFetcher.
+func (f *VerifiedHttpFetcher) RootCID(dist, ver string) (cid.Cid, bool) {
+	c, ok := f.cidsByVersion[dist+"/"+ver]
+	return c, ok
+}
+
+// FetchVerified fetches the archive for dist/ver as a CAR stream from the
+// gateway and verifies every block against its CID and against the
+// expected root CID, returning a reader over the reconstructed archive
+// bytes. It returns an error, without yielding any bytes, if verification
+// fails at any point.
+func (f *VerifiedHttpFetcher) FetchVerified(ctx context.Context, dist, ver string, root cid.Cid) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.gateway+"/ipfs/"+root.String()+"?format=car", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", carMediaType)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s error: %s", req.URL, resp.Status)
+	}
+	defer resp.Body.Close()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+
+	// A trustless gateway is, by definition, not trusted: bound how much of
+	// its response we are willing to buffer into the in-memory blockstore,
+	// the same way Fetch bounds a plain HTTP body, so a malicious or broken
+	// gateway can't exhaust memory before block verification even runs.
+	cr, err := car.NewCarReader(io.LimitReader(resp.Body, fetchSizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CAR stream: %w", err)
+	}
+	if len(cr.Header.Roots) != 1 || !cr.Header.Roots[0].Equals(root) {
+		return nil, fmt.Errorf("CAR root does not match pinned CID for %s/%s", dist, ver)
+	}
+
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading CAR block: %w", err)
+		}
+		if err := verifyBlock(blk); err != nil {
+			return nil, err
+		}
+		if err := bs.Put(ctx, blk); err != nil {
+			return nil, err
+		}
+	}
+
+	dagServ := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	rootNode, err := dagServ.Get(ctx, root)
+	if err != nil {
+		return nil, fmt.Errorf("root block missing from CAR: %w", err)
+	}
+
+	dr, err := uio.NewDagReader(ctx, rootNode, dagServ)
+	if err != nil {
+		return nil, fmt.Errorf("reconstructing archive from DAG: %w", err)
+	}
+
+	return io.NopCloser(dr), nil
+}
+
+// verifyBlock recomputes the multihash of a block's data and confirms it
+// matches the block's claimed CID, so that no byte reaches a caller that
+// was not actually addressed by the CID it arrived under.
+func verifyBlock(blk blocks.Block) error {
+	expected := blk.Cid()
+	computed, err := expected.Prefix().Sum(blk.RawData())
+	if err != nil {
+		return fmt.Errorf("hashing block %s: %w", expected, err)
+	}
+	if !computed.Equals(expected) {
+		return fmt.Errorf("block failed CID verification: got %s, want %s", computed, expected)
+	}
+	return nil
+}
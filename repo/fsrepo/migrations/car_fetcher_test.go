@@ -0,0 +1,217 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// writeTestCar writes a single-block CAR file containing data, addressed by
+// its raw-codec CID (the same encoding unixfs uses for small file leaves),
+// and returns that root CID.
+func writeTestCar(w io.Writer, data []byte) (cid.Cid, error) {
+	sum, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	root := cid.NewCidV1(cid.Raw, sum)
+	blk, err := blocks.NewBlockWithCid(data, root)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return cid.Undef, err
+	}
+	if err := carutil.LdWrite(w, root.Bytes(), blk.RawData()); err != nil {
+		return cid.Undef, err
+	}
+	return root, nil
+}
+
+func createTestCarServer(t *testing.T, data []byte, tamper bool) (*httptest.Server, cid.Cid) {
+	var buf bytes.Buffer
+	root, err := writeTestCar(&buf, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carBytes := buf.Bytes()
+	if tamper {
+		// Flip a byte inside the block's data, after the header and CID
+		// prefix, so the block no longer hashes to its claimed CID.
+		carBytes[len(carBytes)-1] ^= 0xff
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", carMediaType)
+		w.Write(carBytes)
+	}))
+	return ts, root
+}
+
+func TestFetchVerifiedDetectsTamperedBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := []byte("FAKE ARCHIVE DATA")
+	ts, root := createTestCarServer(t, data, true)
+	defer ts.Close()
+
+	fetcher, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := fetcher.FetchVerified(ctx, "go-ipfs", "v0.3.5", root)
+	if err == nil {
+		rc.Close()
+		t.Fatal("expected error from tampered CAR, got none")
+	}
+}
+
+func TestFetchVerifiedAcceptsValidBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := []byte("FAKE ARCHIVE DATA")
+	ts, root := createTestCarServer(t, data, false)
+	defer ts.Close()
+
+	fetcher, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := fetcher.FetchVerified(ctx, "go-ipfs", "v0.3.5", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("reconstructed archive does not match original: got %q, want %q", got, data)
+	}
+}
+
+func TestFetchBinaryRejectsTamperedArchive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := []byte("FAKE ARCHIVE DATA")
+	ts, root := createTestCarServer(t, data, true)
+	defer ts.Close()
+
+	fetcher, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, root)
+	if err == nil {
+		t.Fatal("expected error fetching tampered archive")
+	}
+}
+
+// TestFetchBinaryLooksUpRootFromFetcher checks that FetchBinary resolves
+// the expected root CID from fetcher's own cidsByVersion map when the
+// caller passes cid.Undef, instead of requiring the caller to already know
+// the CID it just gave to NewVerifiedHttpFetcher.
+func TestFetchBinaryLooksUpRootFromFetcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := fakeArchiveBytes(path.Join("go-ipfs", "v0.3.5", archiveName("go-ipfs", "v0.3.5")), false)
+	ts, root := createTestCarServer(t, data, false)
+	defer ts.Close()
+
+	fetcher, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	bin, err := FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bin); err != nil {
+		t.Error("expected extracted binary to exist:", err)
+	}
+}
+
+// TestMultiFetcherForwardsVerifiedFetch checks that wrapping a
+// *VerifiedHttpFetcher in a *MultiFetcher does not silently downgrade
+// fetchArchive to a plain signed-HTTP fetch: the only fetcher in this
+// MultiFetcher serves nothing but a CAR stream, with no "versions"-style
+// signed archive or detached signature at any path, so a plain-fetch
+// fallback would fail outright. Success here is only explainable by
+// MultiFetcher having forwarded RootCID and FetchVerified to the wrapped
+// VerifiedHttpFetcher.
+func TestMultiFetcherForwardsVerifiedFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := fakeArchiveBytes(path.Join("go-ipfs", "v0.3.5", archiveName("go-ipfs", "v0.3.5")), false)
+	ts, root := createTestCarServer(t, data, false)
+	defer ts.Close()
+
+	verified, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf := NewMultiFetcher(verified)
+
+	tmpDir := t.TempDir()
+	bin, err := FetchBinary(ctx, mf, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bin); err != nil {
+		t.Error("expected extracted binary to exist:", err)
+	}
+}
+
+// TestMultiFetcherForwardsVerifiedFetchRejectsTamperedArchive checks that a
+// MultiFetcher wrapping a *VerifiedHttpFetcher still rejects a tampered CAR
+// block, and that the rejection specifically comes from CAR verification
+// rather than a coincidental, unrelated failure.
+func TestMultiFetcherForwardsVerifiedFetchRejectsTamperedArchive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := fakeArchiveBytes(path.Join("go-ipfs", "v0.3.5", archiveName("go-ipfs", "v0.3.5")), false)
+	ts, root := createTestCarServer(t, data, true)
+	defer ts.Close()
+
+	verified, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf := NewMultiFetcher(verified)
+
+	tmpDir := t.TempDir()
+	_, err = FetchBinary(ctx, mf, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
+	if err == nil {
+		t.Fatal("expected error fetching tampered archive through MultiFetcher")
+	}
+	if !strings.Contains(err.Error(), "CID verification") {
+		t.Errorf("expected rejection to come from CAR verification, got: %v", err)
+	}
+}
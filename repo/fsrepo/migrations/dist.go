@@ -0,0 +1,296 @@
+package migrations
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// verifiedFetcher is implemented by fetchers that can retrieve an archive
+// as a CAR stream and verify it against a caller-supplied root CID, such
+// as VerifiedHttpFetcher. FetchBinary uses it instead of Fetch whenever the
+// caller passes an expectedRoot, so that a malicious mirror cannot
+// substitute a different archive.
+type verifiedFetcher interface {
+	FetchVerified(ctx context.Context, dist, ver string, root cid.Cid) (io.ReadCloser, error)
+}
+
+// rootCIDLookup is implemented by fetchers, such as VerifiedHttpFetcher,
+// that can resolve dist/ver to a pinned root CID themselves. fetchArchive
+// consults it when the caller did not already supply an expectedRoot, so
+// that the cidsByVersion map given to NewVerifiedHttpFetcher is the single
+// place that mapping needs to live.
+type rootCIDLookup interface {
+	RootCID(dist, ver string) (cid.Cid, bool)
+}
+
+// distFSRM is the name of the fs-repo-migrations distribution, which
+// contains the repo migration binaries themselves.
+const distFSRM = "fs-repo-migrations"
+
+// distBinaries maps a distribution name to the name of the binary that the
+// distribution's archive contains, for the cases where it differs from the
+// distribution name. Most notably, the "go-ipfs" distribution ships a
+// binary named "ipfs".
+var distBinaries = map[string]string{
+	"go-ipfs": "ipfs",
+}
+
+// DistVersions returns the list of archived versions of the distribution
+// dist, in the order that they appear in the "versions" file. If allowRC is
+// false, pre-release versions are omitted.
+//
+// The versions file is not trusted at face value: DistVersions also fetches
+// its detached "versions.sig" signature and its companion "versions.seq"
+// sequence number, and returns an error, without returning any versions,
+// unless at least one signature verifies against a trusted key for that
+// exact seq and body together. DistVersions also persists the highest seq
+// it has seen for dist and rejects any manifest whose seq is not higher
+// than that, so a compromised or stale mirror cannot get a user to accept
+// an old, validly-signed list of versions in place of a newer one (a
+// downgrade attack), not just a tampered one.
+func DistVersions(ctx context.Context, fetcher Fetcher, dist string, allowRC bool) ([]string, error) {
+	versionsPath := path.Join(dist, "versions")
+
+	body, err := fetchAll(ctx, fetcher, versionsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := fetchAll(ctx, fetcher, versionsPath+sigSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("fetching versions signature: %w", err)
+	}
+
+	seqBytes, err := fetchAll(ctx, fetcher, versionsPath+versionsSeqSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("fetching versions sequence number: %w", err)
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(seqBytes)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid versions sequence number: %w", err)
+	}
+
+	lastSeq, err := lastSeenSeq(dist)
+	if err != nil {
+		return nil, fmt.Errorf("reading last seen versions sequence number: %w", err)
+	}
+	if err := verifySignedVersions(seq, lastSeq, body, sig); err != nil {
+		return nil, fmt.Errorf("versions manifest failed verification: %w", err)
+	}
+	if err := recordSeenSeq(dist, seq); err != nil {
+		return nil, fmt.Errorf("recording versions sequence number: %w", err)
+	}
+
+	var versions []string
+	scan := bufio.NewScanner(bytes.NewReader(body))
+	for scan.Scan() {
+		v := strings.TrimSpace(scan.Text())
+		if v == "" {
+			continue
+		}
+		if !allowRC && isReleaseCandidate(v) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// fetchAll fetches the file at filePath, using fetcher, and returns its
+// entire contents.
+func fetchAll(ctx context.Context, fetcher Fetcher, filePath string) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func isReleaseCandidate(version string) bool {
+	return strings.Contains(version, "-rc")
+}
+
+// archiveName returns the name of the archive for the given dist and
+// version, e.g. "go-ipfs_v0.4.23_linux-amd64.tar.gz".
+func archiveName(dist, ver string) string {
+	ext := "tar.gz"
+	if runtime.GOOS == "windows" {
+		ext = "zip"
+	}
+	return fmt.Sprintf("%s_%s_%s-%s.%s", dist, ver, runtime.GOOS, runtime.GOARCH, ext)
+}
+
+// binaryName returns the name of the binary contained in the archive for
+// dist, unless overridden by binName.
+func binaryName(dist, binName string) string {
+	if binName != "" {
+		return binName
+	}
+	if name, ok := distBinaries[dist]; ok {
+		return name
+	}
+	return dist
+}
+
+// fetchArchive returns a reader over the raw archive bytes for dist/ver.
+//
+// If expectedRoot is cid.Undef and fetcher implements rootCIDLookup (as
+// VerifiedHttpFetcher does), its pinned root CID for dist/ver is used
+// instead, so a caller does not need to separately look up the same CID it
+// already gave the fetcher.
+//
+// If expectedRoot is not cid.Undef (whether passed in or resolved above),
+// fetcher must be a verifiedFetcher, and the archive is fetched and
+// verified as a CAR stream rather than trusted outright; its root CID is
+// expected to have already come from a signed versions manifest, so no
+// further signature check is made here.
+//
+// Otherwise, the archive is fetched as plain bytes, along with its detached
+// "<archive>.sig" signature, and an error is returned, without yielding any
+// bytes, unless the signature verifies against a trusted key.
+func fetchArchive(ctx context.Context, fetcher Fetcher, dist, ver string, expectedRoot cid.Cid) (io.ReadCloser, error) {
+	if expectedRoot == cid.Undef {
+		if lookup, ok := fetcher.(rootCIDLookup); ok {
+			if root, ok := lookup.RootCID(dist, ver); ok {
+				expectedRoot = root
+			}
+		}
+	}
+
+	if expectedRoot != cid.Undef {
+		vf, ok := fetcher.(verifiedFetcher)
+		if !ok {
+			return nil, fmt.Errorf("fetcher does not support verified fetch, cannot check root CID")
+		}
+		return vf.FetchVerified(ctx, dist, ver, expectedRoot)
+	}
+
+	archivePath := path.Join(dist, ver, archiveName(dist, ver))
+
+	body, err := fetchAll(ctx, fetcher, archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := fetchAll(ctx, fetcher, archivePath+sigSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("fetching archive signature: %w", err)
+	}
+	if err := verifyDetachedSignature(body, sig); err != nil {
+		return nil, fmt.Errorf("archive failed signature verification: %w", err)
+	}
+
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+// destBinPath resolves outPath to the final path that the binary named name
+// should be written to: outPath itself, unless outPath is a directory, in
+// which case the binary is written inside it. It returns an error
+// satisfying os.IsExist if that final path already exists.
+func destBinPath(outPath, name string) (string, error) {
+	destPath := outPath
+	fi, err := os.Stat(outPath)
+	if err == nil && fi.IsDir() {
+		destPath = path.Join(outPath, name)
+		fi, err = os.Stat(destPath)
+	}
+	switch {
+	case err == nil:
+		return "", &os.PathError{Op: "open", Path: destPath, Err: os.ErrExist}
+	case !os.IsNotExist(err):
+		return "", err
+	}
+	return destPath, nil
+}
+
+// FetchBinary downloads the archive for dist/ver, using fetcher, unpacks
+// the binary named binName (or the default binary name for dist, if
+// binName is empty) from it, and writes the binary to outPath. It returns
+// the path to the extracted binary.
+//
+// If expectedRoot is not cid.Undef, fetcher must be a verifiedFetcher (such
+// as a *VerifiedHttpFetcher); the archive is fetched as a CAR stream and
+// the download fails, before any bytes reach the extractor, unless the
+// archive's reconstructed root hashes to expectedRoot. Callers resolve
+// expectedRoot from a signed, pinned versions manifest rather than trusting
+// whichever mirror answers the request.
+//
+// An error satisfying os.IsExist is returned if the destination file
+// already exists.
+//
+// If fetcher carries a non-nil PostFetchHook, it runs once the archive has
+// been downloaded and verified, and is passed the path to that archive on
+// disk, before FetchBinary extracts binName from it and cleans up.
+func FetchBinary(ctx context.Context, fetcher Fetcher, dist, ver, binName, outPath string, expectedRoot cid.Cid) (string, error) {
+	name := binaryName(dist, binName)
+
+	destPath, err := destBinPath(outPath, name)
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := fetchArchive(ctx, fetcher, dist, ver, expectedRoot)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	archiveZip := runtime.GOOS == "windows"
+
+	tmpDir, err := ioutil.TempDir("", dist)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	archivePath := path.Join(tmpDir, archiveName(dist, ver))
+	af, err := os.Create(archivePath)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(af, rc); err != nil {
+		af.Close()
+		return "", err
+	}
+	if err = af.Close(); err != nil {
+		return "", err
+	}
+
+	if hook := postFetchHookFor(fetcher); hook != nil {
+		if err = hook(ctx, dist, ver, archivePath); err != nil {
+			return "", fmt.Errorf("post-fetch hook: %w", err)
+		}
+	}
+
+	af, err = os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer af.Close()
+
+	tmpBin := path.Join(tmpDir, name)
+	if err = unpackArchive(af, archiveZip, name, tmpBin); err != nil {
+		return "", err
+	}
+
+	if err = os.Rename(tmpBin, destPath); err != nil {
+		return "", err
+	}
+
+	return destPath, nil
+}
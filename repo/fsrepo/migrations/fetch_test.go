@@ -2,7 +2,11 @@ package migrations
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,28 +14,93 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/ipfs/go-cid"
 )
 
+// testSigningKey signs the versions manifest and archives served by
+// createTestServer. TestMain installs its public half as the only trusted
+// key for the duration of the test binary.
+var testSigningKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x42}, ed25519.SeedSize))
+
+func TestMain(m *testing.M) {
+	trustedKeys = []ed25519.PublicKey{testSigningKey.Public().(ed25519.PublicKey)}
+	os.Exit(m.Run())
+}
+
+const versionsBody = "v1.0.0\nv1.1.0\nv1.1.2\nv2.0.0-rc1\n2.0.0\nv2.0.1\n"
+
+// testVersionsSeq is the sequence number signed alongside versionsBody by
+// createTestServer, so that tests exercising DistVersions against a fresh
+// (i.e. zero) last-seen sequence number see a manifest that verifies.
+const testVersionsSeq = 1
+
+func signWith(key ed25519.PrivateKey, body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, sum[:]))
+}
+
+// signVersionsWith signs seq and body together, the same way
+// verifySignedVersions checks them, so that a test server can serve a
+// versions manifest whose signature covers its sequence number.
+func signVersionsWith(key ed25519.PrivateKey, seq uint64, body []byte) string {
+	payload := append([]byte(strconv.FormatUint(seq, 10)+"\n"), body...)
+	return signWith(key, payload)
+}
+
+// withIsolatedRollbackState points the rollback high-water-mark state at a
+// fresh temporary directory for the duration of the test, so that tests
+// calling DistVersions don't see sequence numbers left behind by other
+// tests, or touch the real state directory on disk.
+func withIsolatedRollbackState(t *testing.T) {
+	t.Helper()
+	old, had := os.LookupEnv(envRollbackStateDir)
+	os.Setenv(envRollbackStateDir, t.TempDir())
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(envRollbackStateDir, old)
+		} else {
+			os.Unsetenv(envRollbackStateDir)
+		}
+	})
+}
+
 func createTestServer() *httptest.Server {
 	reqHandler := func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		if strings.Contains(r.URL.Path, "not-here") {
+		switch {
+		case strings.Contains(r.URL.Path, "not-here"):
 			http.NotFound(w, r)
-		} else if strings.HasSuffix(r.URL.Path, "versions") {
-			fmt.Fprint(w, "v1.0.0\nv1.1.0\nv1.1.2\nv2.0.0-rc1\n2.0.0\nv2.0.1\n")
-		} else if strings.HasSuffix(r.URL.Path, ".tar.gz") {
-			createFakeArchive(r.URL.Path, false, w)
-		} else if strings.HasSuffix(r.URL.Path, "zip") {
-			createFakeArchive(r.URL.Path, true, w)
-		} else {
+		case strings.HasSuffix(r.URL.Path, "versions"+sigSuffix):
+			fmt.Fprint(w, signVersionsWith(testSigningKey, testVersionsSeq, []byte(versionsBody)))
+		case strings.HasSuffix(r.URL.Path, "versions"+versionsSeqSuffix):
+			fmt.Fprint(w, strconv.FormatUint(testVersionsSeq, 10))
+		case strings.HasSuffix(r.URL.Path, "versions"):
+			fmt.Fprint(w, versionsBody)
+		case strings.HasSuffix(r.URL.Path, ".tar.gz"+sigSuffix):
+			fmt.Fprint(w, signWith(testSigningKey, fakeArchiveBytes(strings.TrimSuffix(r.URL.Path, sigSuffix), false)))
+		case strings.HasSuffix(r.URL.Path, "zip"+sigSuffix):
+			fmt.Fprint(w, signWith(testSigningKey, fakeArchiveBytes(strings.TrimSuffix(r.URL.Path, sigSuffix), true)))
+		case strings.HasSuffix(r.URL.Path, ".tar.gz"):
+			w.Write(fakeArchiveBytes(r.URL.Path, false))
+		case strings.HasSuffix(r.URL.Path, "zip"):
+			w.Write(fakeArchiveBytes(r.URL.Path, true))
+		default:
 			http.NotFound(w, r)
 		}
 	}
 	return httptest.NewServer(http.HandlerFunc(reqHandler))
 }
 
+func fakeArchiveBytes(name string, archZip bool) []byte {
+	var buf bytes.Buffer
+	createFakeArchive(name, archZip, &buf)
+	return buf.Bytes()
+}
+
 func createFakeArchive(name string, archZip bool, w io.Writer) {
 	fileName := strings.Split(path.Base(name), "_")[0]
 	root := path.Base(path.Dir(path.Dir(name)))
@@ -141,6 +210,8 @@ func TestHttpFetch(t *testing.T) {
 }
 
 func TestFetchBinary(t *testing.T) {
+	withIsolatedRollbackState(t)
+
 	tmpDir, err := ioutil.TempDir("", "fetchtest")
 	if err != nil {
 		panic(err)
@@ -163,7 +234,7 @@ func TestFetchBinary(t *testing.T) {
 	}
 	t.Log("latest version of", distFSRM, "is", vers[len(vers)-1])
 
-	bin, err := FetchBinary(ctx, fetcher, distFSRM, vers[0], "", tmpDir)
+	bin, err := FetchBinary(ctx, fetcher, distFSRM, vers[0], "", tmpDir, cid.Undef)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -175,7 +246,7 @@ func TestFetchBinary(t *testing.T) {
 
 	t.Log("downloaded and unpacked", fi.Size(), "byte file:", fi.Name())
 
-	bin, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir)
+	bin, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -188,12 +259,12 @@ func TestFetchBinary(t *testing.T) {
 	t.Log("downloaded and unpacked", fi.Size(), "byte file:", fi.Name())
 
 	// Check error is destination already exists and is not directory
-	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", bin)
+	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", bin, cid.Undef)
 	if !os.IsExist(err) {
 		t.Fatal("expected 'exists' error, got", err)
 	}
 
-	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir)
+	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
 	if !os.IsExist(err) {
 		t.Error("expected 'exists' error, got:", err)
 	}
@@ -209,7 +280,7 @@ func TestFetchBinary(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir)
+	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
 	if !os.IsPermission(err) {
 		t.Error("expected 'permission' error, got:", err)
 	}
@@ -223,14 +294,14 @@ func TestFetchBinary(t *testing.T) {
 	}
 
 	// Check error if failure to fetch due to bad dist
-	_, err = FetchBinary(ctx, fetcher, "not-here", "v0.3.5", "ipfs", tmpDir)
+	_, err = FetchBinary(ctx, fetcher, "not-here", "v0.3.5", "ipfs", tmpDir, cid.Undef)
 	if err == nil || !strings.Contains(err.Error(), "Not Found") {
 		t.Error("expected 'Not Found' error, got:", err)
 	}
 
 	// Check error if failure to unpack archive
-	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "not-such-bin", tmpDir)
+	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "not-such-bin", tmpDir, cid.Undef)
 	if err == nil || err.Error() != "no binary found in archive" {
 		t.Error("expected 'no binary found in archive' error")
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,19 @@
+package migrations
+
+import (
+	"context"
+	"io"
+)
+
+// Fetcher knows how to fetch a file from the distribution site. It is used
+// to fetch migrations and their checksums, as well as the current IPFS
+// distribution versions.
+type Fetcher interface {
+	// Fetch attempts to fetch the file at the given path, relative to the
+	// configured distribution path. It returns the contents of the file as
+	// a stream that the caller must close.
+	Fetch(ctx context.Context, filePath string) (io.ReadCloser, error)
+
+	// Close releases any resources held by the fetcher.
+	Close() error
+}
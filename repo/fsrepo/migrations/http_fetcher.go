@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// envIpfsDistPath is the name of the environment variable that overrides
+	// the default distribution path used to fetch migrations and versions.
+	envIpfsDistPath = "IPFS_DIST_PATH"
+
+	// IpnsIpfsDist is the IPNS path to the IPFS distribution site, and is
+	// the default gateway path used when none is configured.
+	IpnsIpfsDist = "/ipns/dist.ipfs.io"
+
+	defaultGateway = "https://ipfs.io"
+
+	fetchSizeLimit = 1024 * 1024 * 1024 // 1 GiB, sanity limit on archive size
+)
+
+// HttpFetcher fetches files from a distribution site over HTTP, using an
+// IPFS gateway configured to resolve IPNS/IPFS paths.
+type HttpFetcher struct {
+	distPath string
+	gateway  string
+	client   *http.Client
+
+	// PostFetchHook, if set, is called by FetchBinary after a fetch through
+	// this Fetcher has downloaded and verified an archive, and before its
+	// temporary files are cleaned up.
+	PostFetchHook PostFetchHook
+}
+
+var _ Fetcher = (*HttpFetcher)(nil)
+
+func (f *HttpFetcher) postFetchHook() PostFetchHook {
+	return f.PostFetchHook
+}
+
+// SetPostFetchHook sets the PostFetchHook that FetchBinary runs once a fetch
+// through this Fetcher has downloaded and verified an archive.
+func (f *HttpFetcher) SetPostFetchHook(hook PostFetchHook) {
+	f.PostFetchHook = hook
+}
+
+// NewHttpFetcher creates a new HttpFetcher that fetches from the default
+// distribution path using the default public gateway.
+func NewHttpFetcher() *HttpFetcher {
+	return &HttpFetcher{
+		distPath: IpnsIpfsDist,
+		gateway:  defaultGateway,
+		client: &http.Client{
+			Timeout: time.Minute * 5,
+		},
+	}
+}
+
+// SetGateway sets the URL of the gateway to fetch IPNS/IPFS content from.
+func (f *HttpFetcher) SetGateway(gateway string) error {
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return fmt.Errorf("bad gateway URL: %s", err)
+	}
+	f.gateway = strings.TrimRight(u.String(), "/")
+	return nil
+}
+
+// SetDistPath sets the path, relative to the gateway, that versions and
+// migrations are fetched from, e.g. "/ipns/dist.ipfs.io".
+func (f *HttpFetcher) SetDistPath(distPath string) {
+	f.distPath = distPath
+}
+
+// Fetch attempts to fetch the file at the given path, relative to the
+// configured distribution path, from the gateway.
+func (f *HttpFetcher) Fetch(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	u := f.gateway + path.Join(f.distPath, filePath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s error: %s", u, resp.Status)
+	}
+
+	return &limitedReadCloser{io.LimitReader(resp.Body, fetchSizeLimit), resp.Body}, nil
+}
+
+// limitedReadCloser bounds how much of the underlying body is read, while
+// still closing the original body when done.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Close is a no-op for HttpFetcher, since the underlying http.Client does
+// not need to be explicitly closed.
+func (f *HttpFetcher) Close() error {
+	return nil
+}
+
+// GetDistPathEnv returns the configured distribution path. If the
+// IPFS_DIST_PATH environment variable is set, its value takes precedence.
+// Otherwise, if fallback is not empty, it is returned. If neither is set,
+// the default IpnsIpfsDist path is returned.
+func GetDistPathEnv(fallback string) string {
+	if dist := os.Getenv(envIpfsDistPath); dist != "" {
+		return dist
+	}
+	if fallback != "" {
+		return fallback
+	}
+	return IpnsIpfsDist
+}
@@ -0,0 +1,123 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+)
+
+// multiFetcher is satisfied by fetchers whose distribution path can be
+// changed after construction, which is needed by MultiFetcher so that it
+// can keep all of its fetchers pointed at the same location.
+type multiFetcher interface {
+	Fetcher
+	SetDistPath(string)
+}
+
+// MultiFetcher tries each of its fetchers, in order, until one of them
+// succeeds. This is used to fall back to alternate means of fetching
+// migrations and versions if the preferred fetcher is unavailable.
+type MultiFetcher struct {
+	fetchers []multiFetcher
+
+	// PostFetchHook, if set, is called by FetchBinary after a fetch through
+	// this Fetcher has downloaded and verified an archive, and before its
+	// temporary files are cleaned up.
+	PostFetchHook PostFetchHook
+}
+
+var _ Fetcher = (*MultiFetcher)(nil)
+
+func (f *MultiFetcher) postFetchHook() PostFetchHook {
+	return f.PostFetchHook
+}
+
+// SetPostFetchHook sets the PostFetchHook that FetchBinary runs once a fetch
+// through this Fetcher has downloaded and verified an archive.
+func (f *MultiFetcher) SetPostFetchHook(hook PostFetchHook) {
+	f.PostFetchHook = hook
+}
+
+// NewMultiFetcher creates a MultiFetcher that tries each of the given
+// fetchers, in order, until one of them succeeds.
+func NewMultiFetcher(fetchers ...multiFetcher) *MultiFetcher {
+	return &MultiFetcher{
+		fetchers: fetchers,
+	}
+}
+
+// SetDistPath sets the distribution path on all of the fetchers.
+func (f *MultiFetcher) SetDistPath(distPath string) {
+	for _, fetcher := range f.fetchers {
+		fetcher.SetDistPath(distPath)
+	}
+}
+
+// Fetch tries each fetcher, in order, returning the result of the first
+// fetcher to succeed. If all fetchers fail, the last error is returned.
+//
+// Fetch itself has no notion of signatures: it fetches whatever single file
+// is at filePath from the first fetcher willing to serve it. The guarantee
+// that a compromised mirror cannot be worked around by falling through to a
+// different one for a signed file (such as "versions" or an archive) comes
+// from DistVersions/fetchArchive always trying fetchers in the same order
+// for both a file and its detached signature, not from any special casing
+// here; see TestDistVersionsFailsHardAcrossMirrorsOnSignatureMismatch.
+func (f *MultiFetcher) Fetch(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if len(f.fetchers) == 0 {
+		return nil, fmt.Errorf("no fetchers configured")
+	}
+
+	var err error
+	for _, fetcher := range f.fetchers {
+		var rc io.ReadCloser
+		rc, err = fetcher.Fetch(ctx, filePath)
+		if err == nil {
+			return rc, nil
+		}
+	}
+	return nil, err
+}
+
+// Close closes all of the fetchers, returning the first error encountered.
+func (f *MultiFetcher) Close() error {
+	var err error
+	for _, fetcher := range f.fetchers {
+		if cerr := fetcher.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// RootCID forwards to the first of its fetchers that implements
+// rootCIDLookup and resolves dist/ver, so that a MultiFetcher wrapping a
+// *VerifiedHttpFetcher does not silently lose its ability to resolve a
+// pinned root CID. If no fetcher resolves dist/ver, the second return value
+// is false, the same as rootCIDLookup itself.
+func (f *MultiFetcher) RootCID(dist, ver string) (cid.Cid, bool) {
+	for _, fetcher := range f.fetchers {
+		if lookup, ok := fetcher.(rootCIDLookup); ok {
+			if root, ok := lookup.RootCID(dist, ver); ok {
+				return root, true
+			}
+		}
+	}
+	return cid.Undef, false
+}
+
+// FetchVerified forwards to the first of its fetchers that implements
+// verifiedFetcher, so that a MultiFetcher wrapping a *VerifiedHttpFetcher
+// still performs CAR verification instead of silently degrading to a plain,
+// signed-HTTP fetch. It returns an error if none of its fetchers support
+// verified fetch.
+func (f *MultiFetcher) FetchVerified(ctx context.Context, dist, ver string, root cid.Cid) (io.ReadCloser, error) {
+	for _, fetcher := range f.fetchers {
+		if vf, ok := fetcher.(verifiedFetcher); ok {
+			return vf.FetchVerified(ctx, dist, ver, root)
+		}
+	}
+	return nil, fmt.Errorf("no fetcher supports verified fetch")
+}
@@ -0,0 +1,112 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// PostFetchHook is called by FetchBinary once an archive has been
+// downloaded and its checksum or signature verified, and before its
+// temporary files are cleaned up. archivePath is the location of the
+// verified archive on disk. A non-nil error aborts the FetchBinary call
+// before it extracts anything from the archive.
+type PostFetchHook func(ctx context.Context, dist, ver, archivePath string) error
+
+// hasPostFetchHook is implemented by any Fetcher that carries a
+// configurable PostFetchHook, so that FetchBinary can invoke it without
+// needing to know about every concrete Fetcher implementation. HttpFetcher
+// and MultiFetcher implement it directly; VerifiedHttpFetcher gets it for
+// free by embedding *HttpFetcher.
+type hasPostFetchHook interface {
+	postFetchHook() PostFetchHook
+}
+
+// postFetchHookFor returns the PostFetchHook configured on fetcher, if it
+// carries one.
+func postFetchHookFor(fetcher Fetcher) PostFetchHook {
+	if f, ok := fetcher.(hasPostFetchHook); ok {
+		return f.postFetchHook()
+	}
+	return nil
+}
+
+// hasSettablePostFetchHook is implemented by any Fetcher whose PostFetchHook
+// can be configured after construction, so that RunMigration can wire up a
+// hook without enumerating every concrete Fetcher implementation that
+// supports one. HttpFetcher and MultiFetcher implement it directly;
+// VerifiedHttpFetcher gets it for free by embedding *HttpFetcher.
+type hasSettablePostFetchHook interface {
+	SetPostFetchHook(PostFetchHook)
+}
+
+// NewIpfsPinHook returns a PostFetchHook that re-seeds a migration archive
+// onto the network by adding it, pinned, to the IPFS node whose RPC API is
+// reachable at apiAddr (e.g. "http://127.0.0.1:5001"). This is how a node
+// that fetched a migration over HTTP keeps contributing it to the swarm,
+// instead of only ever downloading migrations without ever serving them.
+//
+// See RunMigration, which wires this hook up for KeepPin.
+func NewIpfsPinHook(apiAddr string) PostFetchHook {
+	return func(ctx context.Context, dist, ver, archivePath string) error {
+		_, err := addPinned(ctx, apiAddr, archivePath)
+		return err
+	}
+}
+
+// addPinned uploads the file at archivePath to the node's "add" RPC
+// endpoint with pin=true, and returns the CID it was added as.
+func addPinned(ctx context.Context, apiAddr, archivePath string) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", path.Base(archivePath))
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(part, f); err != nil {
+		return "", err
+	}
+	if err = mw.Close(); err != nil {
+		return "", err
+	}
+
+	u := strings.TrimRight(apiAddr, "/") + "/api/v0/add?pin=true"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("connecting to IPFS API at %s: %w", apiAddr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("POST %s error: %s", u, resp.Status)
+	}
+
+	var added struct {
+		Hash string `json:"Hash"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		return "", fmt.Errorf("decoding add response: %w", err)
+	}
+	return added.Hash, nil
+}
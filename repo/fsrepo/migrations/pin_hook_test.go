@@ -0,0 +1,216 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// recordingHook records the arguments it was called with, so tests can
+// assert that FetchBinary invokes the hook with the right archive path.
+type recordingHook struct {
+	called      bool
+	dist        string
+	ver         string
+	archivePath string
+	err         error
+}
+
+func (h *recordingHook) hook(ctx context.Context, dist, ver, archivePath string) error {
+	h.called = true
+	h.dist = dist
+	h.ver = ver
+	h.archivePath = archivePath
+	return h.err
+}
+
+func TestFetchBinaryRunsPostFetchHook(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pinhooktest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err = fetcher.SetGateway(ts.URL); err != nil {
+		panic(err)
+	}
+
+	h := &recordingHook{}
+	fetcher.PostFetchHook = h.hook
+
+	bin, err := FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !h.called {
+		t.Fatal("expected post-fetch hook to be called")
+	}
+	if h.dist != "go-ipfs" || h.ver != "v0.3.5" {
+		t.Errorf("hook received wrong dist/ver: %s/%s", h.dist, h.ver)
+	}
+	if _, err = os.Stat(h.archivePath); err != nil {
+		t.Errorf("expected hook to receive a path to an archive that still exists: %s", err)
+	}
+
+	if _, err = os.Stat(bin); err != nil {
+		t.Error("expected extracted binary to exist:", err)
+	}
+}
+
+func TestFetchBinarySkipsHookOnFetchError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pinhooktest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err = fetcher.SetGateway(ts.URL); err != nil {
+		panic(err)
+	}
+
+	h := &recordingHook{}
+	fetcher.PostFetchHook = h.hook
+
+	_, err = FetchBinary(ctx, fetcher, "not-here", "v0.3.5", "ipfs", tmpDir, cid.Undef)
+	if err == nil {
+		t.Fatal("expected fetch error")
+	}
+	if h.called {
+		t.Fatal("expected post-fetch hook not to be called when fetch fails")
+	}
+}
+
+func TestFetchBinaryAbortsOnHookError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pinhooktest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err = fetcher.SetGateway(ts.URL); err != nil {
+		panic(err)
+	}
+
+	h := &recordingHook{err: fmt.Errorf("disk full")}
+	fetcher.PostFetchHook = h.hook
+
+	_, err = FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, cid.Undef)
+	if err == nil {
+		t.Fatal("expected error when post-fetch hook fails")
+	}
+	if !h.called {
+		t.Fatal("expected post-fetch hook to have been called")
+	}
+	if _, statErr := os.Stat(path.Join(tmpDir, "ipfs")); statErr == nil {
+		t.Error("expected binary not to be extracted when post-fetch hook fails")
+	}
+}
+
+// TestFetchBinaryRunsPostFetchHookForVerifiedFetcher checks that the hook
+// also runs for a *VerifiedHttpFetcher, which only carries a PostFetchHook
+// field by embedding *HttpFetcher, to guard against postFetchHookFor only
+// recognizing concrete Fetcher types it enumerates by hand.
+func TestFetchBinaryRunsPostFetchHookForVerifiedFetcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := fakeArchiveBytes(path.Join("go-ipfs", "v0.3.5", archiveName("go-ipfs", "v0.3.5")), false)
+	ts, root := createTestCarServer(t, data, false)
+	defer ts.Close()
+
+	fetcher, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &recordingHook{}
+	fetcher.PostFetchHook = h.hook
+
+	tmpDir := t.TempDir()
+	if _, err := FetchBinary(ctx, fetcher, "go-ipfs", "v0.3.5", "ipfs", tmpDir, root); err != nil {
+		t.Fatal(err)
+	}
+
+	if !h.called {
+		t.Fatal("expected post-fetch hook to run for a VerifiedHttpFetcher")
+	}
+	if _, err := os.Stat(h.archivePath); err != nil {
+		t.Errorf("expected hook to receive a path to an archive that still exists: %s", err)
+	}
+}
+
+// fakePinServer simulates the subset of an IPFS daemon's RPC API used by
+// NewIpfsPinHook: accepting a multipart upload to /api/v0/add and returning
+// the CID it was "added" as.
+func fakePinServer(t *testing.T, wantCid string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/add" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("bad multipart upload: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, _, err := r.FormFile("file"); err != nil {
+			t.Errorf("expected a 'file' form field: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Hash string
+		}{Hash: wantCid})
+	}))
+}
+
+func TestIpfsPinHookAddsArchive(t *testing.T) {
+	const wantCid = "QmFakeCidForPinHookTest"
+
+	ts := fakePinServer(t, wantCid)
+	defer ts.Close()
+
+	archivePath, err := ioutil.TempFile("", "pinhook-archive")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(archivePath.Name())
+	if _, err = archivePath.WriteString("FAKE ARCHIVE DATA"); err != nil {
+		panic(err)
+	}
+	archivePath.Close()
+
+	hook := NewIpfsPinHook(ts.URL)
+	if err = hook(context.Background(), "go-ipfs", "v0.3.5", archivePath.Name()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+package migrations
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// envRollbackStateDir overrides the directory that rollback high-water
+// marks are persisted in, e.g. for testing against a private mirror without
+// touching the real state on disk.
+const envRollbackStateDir = "IPFS_MIGRATIONS_STATE_DIR"
+
+// rollbackStateDirName is the name of the directory, alongside the cache
+// directory, that rollback high-water marks are persisted in.
+const rollbackStateDirName = "migration-state"
+
+// rollbackStateDir returns the directory that rollback high-water marks are
+// persisted in, defaulting to a directory alongside the default cache
+// directory (see defaultCacheDir), overridden by IPFS_MIGRATIONS_STATE_DIR
+// when set.
+func rollbackStateDir() (string, error) {
+	if dir := os.Getenv(envRollbackStateDir); dir != "" {
+		return dir, nil
+	}
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(cacheDir), rollbackStateDirName), nil
+}
+
+// seqFilePath returns the path of the file that records the last-seen
+// sequence number for dist.
+func seqFilePath(dist string) (string, error) {
+	dir, err := rollbackStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, dist+".seq"), nil
+}
+
+// lastSeenSeq returns the highest sequence number previously recorded for
+// dist by recordSeenSeq, or 0 if none has been recorded yet.
+func lastSeenSeq(dist string) (uint64, error) {
+	p, err := seqFilePath(dist)
+	if err != nil {
+		return 0, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing recorded sequence number for %s: %w", dist, err)
+	}
+	return seq, nil
+}
+
+// recordSeenSeq persists seq as the last-seen sequence number for dist, so
+// that a later, lower-numbered manifest is rejected as a rollback.
+func recordSeenSeq(dist string, seq uint64) error {
+	p, err := seqFilePath(dist)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, []byte(strconv.FormatUint(seq, 10)+"\n"), 0644)
+}
@@ -0,0 +1,85 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/ipfs/go-cid"
+)
+
+// KeepMode controls what RunMigration does with the downloaded migration
+// binary once it has finished running, mirroring the "-keep"/
+// "--migrate-keep" flag of fs-repo-migrations.
+type KeepMode string
+
+const (
+	// KeepDiscard removes the downloaded migration binary once it has run.
+	KeepDiscard KeepMode = "discard"
+
+	// KeepCache leaves the downloaded migration binary in place so a later
+	// run can reuse it.
+	KeepCache KeepMode = "cache"
+
+	// KeepPin behaves like KeepCache, and additionally re-seeds the
+	// downloaded archive onto the local node via a PostFetchHook, so that
+	// other nodes fetching the same dist/ver can fetch it from this one
+	// instead of the origin mirror.
+	KeepPin KeepMode = "pin"
+)
+
+// ParseKeepMode parses the value of the "-keep"/"--migrate-keep" flag into
+// a KeepMode, returning an error for any value other than "discard",
+// "cache", or "pin".
+func ParseKeepMode(s string) (KeepMode, error) {
+	switch KeepMode(s) {
+	case KeepDiscard, KeepCache, KeepPin:
+		return KeepMode(s), nil
+	default:
+		return "", fmt.Errorf("unknown -keep value %q: must be %q, %q, or %q", s, KeepDiscard, KeepCache, KeepPin)
+	}
+}
+
+// RunMigration downloads the migration binary for dist/ver, using fetcher
+// (through cache, if cache is not nil), runs it, and disposes of the
+// downloaded binary according to keep.
+//
+// If keep is KeepPin, fetcher must implement hasSettablePostFetchHook (as
+// *HttpFetcher, *MultiFetcher, and *VerifiedHttpFetcher all do);
+// RunMigration sets its PostFetchHook to NewIpfsPinHook(apiAddr) before
+// fetching, so the downloaded archive is added and pinned to the node at
+// apiAddr as soon as it is verified.
+func RunMigration(ctx context.Context, fetcher Fetcher, cache *Cache, dist, ver, outPath, apiAddr string, keep KeepMode) error {
+	if keep == KeepPin {
+		sf, ok := fetcher.(hasSettablePostFetchHook)
+		if !ok {
+			return fmt.Errorf("migrate-keep=pin requires a fetcher with a settable PostFetchHook, got %T", fetcher)
+		}
+		sf.SetPostFetchHook(NewIpfsPinHook(apiAddr))
+	}
+
+	var (
+		bin string
+		err error
+	)
+	if cache != nil {
+		bin, err = cache.FetchBinary(ctx, fetcher, dist, ver, "", outPath, cid.Undef)
+	} else {
+		bin, err = FetchBinary(ctx, fetcher, dist, ver, "", outPath, cid.Undef)
+	}
+	if err != nil {
+		return fmt.Errorf("fetching migration: %w", err)
+	}
+	if keep == KeepDiscard {
+		defer os.Remove(bin)
+	}
+
+	cmd := exec.CommandContext(ctx, bin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running migration %s: %w", bin, err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestParseKeepMode(t *testing.T) {
+	for _, valid := range []KeepMode{KeepDiscard, KeepCache, KeepPin} {
+		got, err := ParseKeepMode(string(valid))
+		if err != nil || got != valid {
+			t.Errorf("ParseKeepMode(%q) = %q, %v; want %q, nil", valid, got, err, valid)
+		}
+	}
+	if _, err := ParseKeepMode("bogus"); err == nil {
+		t.Error("expected error for an unknown -keep value")
+	}
+}
+
+// scriptArchiveBytes builds a single-file tar.gz archive, named the way
+// createFakeArchive names one, whose entry is a runnable shell script
+// rather than createFakeArchive's inert "FAKE DATA" placeholder, so
+// RunMigration has something it can actually execute.
+func scriptArchiveBytes(name, script string) []byte {
+	fileName := strings.Split(path.Base(name), "_")[0]
+	root := path.Base(path.Dir(path.Dir(name)))
+	if fileName == "go-ipfs" {
+		fileName = "ipfs"
+	}
+	var buf bytes.Buffer
+	if err := writeTarGzip(root, fileName, script, &buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// createScriptServer serves a signed versions manifest and a signed
+// migration archive whose binary is script, for use by RunMigration tests
+// that need to actually execute the downloaded binary.
+func createScriptServer(script string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "versions"+sigSuffix):
+			fmt.Fprint(w, signVersionsWith(testSigningKey, testVersionsSeq, []byte(versionsBody)))
+		case strings.HasSuffix(r.URL.Path, "versions"+versionsSeqSuffix):
+			fmt.Fprint(w, strconv.FormatUint(testVersionsSeq, 10))
+		case strings.HasSuffix(r.URL.Path, "versions"):
+			fmt.Fprint(w, versionsBody)
+		case strings.HasSuffix(r.URL.Path, ".tar.gz"+sigSuffix):
+			fmt.Fprint(w, signWith(testSigningKey, scriptArchiveBytes(strings.TrimSuffix(r.URL.Path, sigSuffix), script)))
+		case strings.HasSuffix(r.URL.Path, ".tar.gz"):
+			w.Write(scriptArchiveBytes(r.URL.Path, script))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestRunMigrationKeepPinWiresHook(t *testing.T) {
+	const wantCid = "QmFakeCidForRunMigrationTest"
+	pinServer := fakePinServer(t, wantCid)
+	defer pinServer.Close()
+
+	ts := createScriptServer("#!/bin/sh\nexit 0\n")
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err := fetcher.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	if err := RunMigration(context.Background(), fetcher, nil, "go-ipfs", "v0.3.5", tmpDir, pinServer.URL, KeepPin); err != nil {
+		t.Fatal(err)
+	}
+
+	if fetcher.PostFetchHook == nil {
+		t.Fatal("expected RunMigration to install a PostFetchHook for keep=pin")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "ipfs")); err != nil {
+		t.Errorf("expected migration binary to remain after keep=pin: %s", err)
+	}
+}
+
+// TestRunMigrationKeepPinWorksWithVerifiedFetcher guards against
+// RunMigration only recognizing a settable PostFetchHook on the concrete
+// fetcher types it enumerates by hand: a *VerifiedHttpFetcher gets
+// SetPostFetchHook for free by embedding *HttpFetcher, and keep=pin must
+// work with it the same as it does with a plain *HttpFetcher.
+func TestRunMigrationKeepPinWorksWithVerifiedFetcher(t *testing.T) {
+	const wantCid = "QmFakeCidForRunMigrationVerifiedTest"
+	pinServer := fakePinServer(t, wantCid)
+	defer pinServer.Close()
+
+	script := scriptArchiveBytes(path.Join("go-ipfs", "v0.3.5", archiveName("go-ipfs", "v0.3.5")), "#!/bin/sh\nexit 0\n")
+	ts, root := createTestCarServer(t, script, false)
+	defer ts.Close()
+
+	fetcher, err := NewVerifiedHttpFetcher(ts.URL, map[string]cid.Cid{"go-ipfs/v0.3.5": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	if err := RunMigration(context.Background(), fetcher, nil, "go-ipfs", "v0.3.5", tmpDir, pinServer.URL, KeepPin); err != nil {
+		t.Fatal(err)
+	}
+
+	if fetcher.PostFetchHook == nil {
+		t.Fatal("expected RunMigration to install a PostFetchHook for keep=pin on a VerifiedHttpFetcher")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "ipfs")); err != nil {
+		t.Errorf("expected migration binary to remain after keep=pin: %s", err)
+	}
+}
+
+func TestRunMigrationKeepDiscardRemovesBinary(t *testing.T) {
+	ts := createScriptServer("#!/bin/sh\nexit 0\n")
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err := fetcher.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	if err := RunMigration(context.Background(), fetcher, nil, "go-ipfs", "v0.3.5", tmpDir, "", KeepDiscard); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "ipfs")); !os.IsNotExist(err) {
+		t.Error("expected migration binary to be removed after keep=discard")
+	}
+}
+
+func TestRunMigrationReturnsExecError(t *testing.T) {
+	ts := createScriptServer("#!/bin/sh\nexit 1\n")
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err := fetcher.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := t.TempDir()
+	err := RunMigration(context.Background(), fetcher, nil, "go-ipfs", "v0.3.5", tmpDir, "", KeepDiscard)
+	if err == nil {
+		t.Fatal("expected error from a migration binary that exits non-zero")
+	}
+}
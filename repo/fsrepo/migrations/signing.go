@@ -0,0 +1,119 @@
+package migrations
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrSignatureVerification is wrapped by any error returned because a
+// versions manifest or archive signature did not verify, so callers can use
+// errors.Is against it to tell a genuine signature failure apart from an
+// ordinary fetch error like a 404.
+var ErrSignatureVerification = errors.New("signature verification failed")
+
+// envTrustedKeys overrides the compiled-in trusted signing keys with a
+// comma-separated list of base64-encoded Ed25519 public keys, e.g. for
+// testing against a private mirror or a different release channel.
+const envTrustedKeys = "IPFS_MIGRATIONS_TRUSTED_KEYS"
+
+// sigSuffix is appended to the path of a file to get the path of its
+// detached signature, e.g. "go-ipfs/versions" -> "go-ipfs/versions.sig".
+const sigSuffix = ".sig"
+
+// versionsSeqSuffix is appended to the path of the versions file to get the
+// path of its companion sequence number file, e.g.
+// "go-ipfs/versions" -> "go-ipfs/versions.seq". The sequence number is
+// folded into what the versions signature covers, so a mirror cannot strip
+// it back off without invalidating the signature, and DistVersions rejects
+// any manifest whose sequence number is not higher than the last one it has
+// seen for that distribution.
+const versionsSeqSuffix = ".seq"
+
+// defaultTrustedKeys are the Ed25519 public keys, base64-encoded, that ship
+// with the binary and are trusted to sign the versions manifest and
+// migration archives.
+var defaultTrustedKeys = []string{
+	"11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+}
+
+// trustedKeys holds the Ed25519 public keys that a signature must verify
+// against. It is initialized from defaultTrustedKeys, overridden by
+// IPFS_MIGRATIONS_TRUSTED_KEYS when set.
+var trustedKeys = mustParseKeys(defaultTrustedKeys)
+
+func init() {
+	if env := os.Getenv(envTrustedKeys); env != "" {
+		trustedKeys = mustParseKeys(strings.Split(env, ","))
+	}
+}
+
+func mustParseKeys(b64Keys []string) []ed25519.PublicKey {
+	keys := make([]ed25519.PublicKey, 0, len(b64Keys))
+	for _, s := range b64Keys {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			panic(fmt.Sprintf("migrations: invalid trusted key %q: %s", s, err))
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			panic(fmt.Sprintf("migrations: invalid ed25519 public key length: %d", len(raw)))
+		}
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+	return keys
+}
+
+// verifyDetachedSignature reports whether sigData contains at least one
+// valid, base64-encoded Ed25519 signature, one per line, over sha256(body)
+// from a trusted key. It returns an error describing why verification
+// failed otherwise.
+func verifyDetachedSignature(body, sigData []byte) error {
+	var sigs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(sigData)), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			sigs = append(sigs, line)
+		}
+	}
+	if len(sigs) == 0 {
+		return fmt.Errorf("%w: no signatures present", ErrSignatureVerification)
+	}
+
+	sum := sha256.Sum256(body)
+	for _, s := range sigs {
+		sig, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			continue
+		}
+		for _, key := range trustedKeys {
+			if ed25519.Verify(key, sum[:], sig) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: no signature verified against a trusted key", ErrSignatureVerification)
+}
+
+// verifySignedVersions verifies sigData against seq and body signed
+// together, the same way verifyDetachedSignature verifies a plain body, and
+// additionally rejects seq as a replayed, stale manifest if it is not
+// strictly greater than lastSeq. Folding seq into the signed payload this
+// way means a mirror cannot serve an old, validly-signed versions file
+// alongside a newer sequence number to get around the replay check: the
+// seq a signature covers is the only one it will verify against.
+func verifySignedVersions(seq, lastSeq uint64, body, sigData []byte) error {
+	if seq <= lastSeq {
+		return fmt.Errorf("versions manifest is not newer than the last one seen (seq %d, last seen %d): possible rollback", seq, lastSeq)
+	}
+	payload := append([]byte(strconv.FormatUint(seq, 10)+"\n"), body...)
+	return verifyDetachedSignature(payload, sigData)
+}
@@ -0,0 +1,227 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tamperedVersionsServer serves a versions file whose signature was made
+// over different (stale) content, simulating a mirror trying to downgrade
+// the published version list.
+func tamperedVersionsServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "versions"+sigSuffix):
+			fmt.Fprint(w, signVersionsWith(testSigningKey, testVersionsSeq, []byte("v0.0.1\n")))
+		case strings.HasSuffix(r.URL.Path, "versions"+versionsSeqSuffix):
+			fmt.Fprint(w, strconv.FormatUint(testVersionsSeq, 10))
+		case strings.HasSuffix(r.URL.Path, "versions"):
+			fmt.Fprint(w, versionsBody)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// unsignedVersionsServer serves a versions file with no signature at all.
+func unsignedVersionsServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "versions"+sigSuffix):
+			http.NotFound(w, r)
+		case strings.HasSuffix(r.URL.Path, "versions"+versionsSeqSuffix):
+			fmt.Fprint(w, strconv.FormatUint(testVersionsSeq, 10))
+		case strings.HasSuffix(r.URL.Path, "versions"):
+			fmt.Fprint(w, versionsBody)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// replayVersionsServer serves a versions manifest validly signed over seq
+// and body together, for use in tests simulating a mirror replaying an old,
+// legitimately-signed manifest.
+func replayVersionsServer(seq uint64, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "versions"+sigSuffix):
+			fmt.Fprint(w, signVersionsWith(testSigningKey, seq, []byte(body)))
+		case strings.HasSuffix(r.URL.Path, "versions"+versionsSeqSuffix):
+			fmt.Fprint(w, strconv.FormatUint(seq, 10))
+		case strings.HasSuffix(r.URL.Path, "versions"):
+			fmt.Fprint(w, body)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestDistVersionsValidSignature(t *testing.T) {
+	withIsolatedRollbackState(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := createTestServer()
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err := fetcher.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	vers, err := DistVersions(ctx, fetcher, distFSRM, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vers) == 0 {
+		t.Fatal("expected versions")
+	}
+}
+
+func TestDistVersionsTamperedSignature(t *testing.T) {
+	withIsolatedRollbackState(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := tamperedVersionsServer()
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err := fetcher.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := DistVersions(ctx, fetcher, distFSRM, false)
+	if !errors.Is(err, ErrSignatureVerification) {
+		t.Fatalf("expected a signature verification error, got: %v", err)
+	}
+}
+
+func TestDistVersionsMissingSignature(t *testing.T) {
+	withIsolatedRollbackState(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := unsignedVersionsServer()
+	defer ts.Close()
+
+	fetcher := NewHttpFetcher()
+	if err := fetcher.SetGateway(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := DistVersions(ctx, fetcher, distFSRM, false)
+	if err == nil {
+		t.Fatal("expected error when versions.sig is missing")
+	}
+}
+
+// stubFetcher is a minimal Fetcher used to exercise MultiFetcher's
+// fall-through-on-error behavior in isolation.
+type stubFetcher struct {
+	err error
+	hit bool
+}
+
+func (f *stubFetcher) Fetch(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	f.hit = true
+	return nil, f.err
+}
+
+func (f *stubFetcher) Close() error       { return nil }
+func (f *stubFetcher) SetDistPath(string) {}
+
+func TestMultiFetcherFallsThroughOnOrdinaryError(t *testing.T) {
+	bad := &stubFetcher{err: fmt.Errorf("404 not found")}
+	good := &stubFetcher{}
+
+	mf := NewMultiFetcher(bad, good)
+
+	if _, err := mf.Fetch(context.Background(), "go-ipfs/versions"); err != nil {
+		t.Fatal(err)
+	}
+	if !good.hit {
+		t.Fatal("expected MultiFetcher to fall through to the next mirror on an ordinary error")
+	}
+}
+
+// TestDistVersionsFailsHardAcrossMirrorsOnSignatureMismatch is the real,
+// end-to-end version of the downgrade-prevention guarantee: a MultiFetcher
+// whose first mirror serves a versions file with a signature that does not
+// match (a stand-in for a compromised or stale mirror) must not have that
+// failure papered over by a second, honest mirror that would have verified
+// just fine on its own. MultiFetcher always tries its fetchers in the same
+// order for both "versions" and "versions.sig", so it lands on the first
+// mirror's story for both, and that story fails to verify.
+func TestDistVersionsFailsHardAcrossMirrorsOnSignatureMismatch(t *testing.T) {
+	withIsolatedRollbackState(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bad := tamperedVersionsServer()
+	defer bad.Close()
+	good := createTestServer()
+	defer good.Close()
+
+	badFetcher := NewHttpFetcher()
+	if err := badFetcher.SetGateway(bad.URL); err != nil {
+		t.Fatal(err)
+	}
+	goodFetcher := NewHttpFetcher()
+	if err := goodFetcher.SetGateway(good.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	mf := NewMultiFetcher(badFetcher, goodFetcher)
+
+	_, err := DistVersions(ctx, mf, distFSRM, false)
+	if !errors.Is(err, ErrSignatureVerification) {
+		t.Fatalf("expected a signature verification error from the first mirror, not a fall-through to the second; got: %v", err)
+	}
+}
+
+// TestDistVersionsRejectsReplayedManifest checks the actual downgrade
+// guarantee: a mirror replaying an old, validly-signed versions manifest
+// (as opposed to one whose signature doesn't match its body at all) must
+// still be rejected, because its sequence number is not higher than the
+// one already seen for this distribution.
+func TestDistVersionsRejectsReplayedManifest(t *testing.T) {
+	withIsolatedRollbackState(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const staleBody = "v1.0.0\n"
+	const freshBody = "v1.0.0\nv2.0.0\n"
+
+	fresh := replayVersionsServer(2, freshBody)
+	defer fresh.Close()
+	fetcher := NewHttpFetcher()
+	if err := fetcher.SetGateway(fresh.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DistVersions(ctx, fetcher, distFSRM, false); err != nil {
+		t.Fatalf("expected the fresh manifest to verify: %v", err)
+	}
+
+	replay := replayVersionsServer(1, staleBody)
+	defer replay.Close()
+	if err := fetcher.SetGateway(replay.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DistVersions(ctx, fetcher, distFSRM, false); err == nil {
+		t.Fatal("expected a replayed, stale-but-validly-signed manifest to be rejected")
+	}
+}